@@ -14,10 +14,13 @@
 package resource
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"html/template"
 	"image/color"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -39,6 +42,9 @@ import (
 	// Import webp codec
 	"sync"
 
+	"github.com/Kagami/go-avif"
+	"github.com/chai2010/webp"
+	"github.com/rwcarlsen/goexif/exif"
 	_ "golang.org/x/image/webp"
 )
 
@@ -56,6 +62,31 @@ type Imaging struct {
 
 	// Resample filter used. See https://github.com/disintegration/imaging
 	ResampleFilter string
+
+	// DefaultFormat is the image format used for processed images when no
+	// format token is given in the resize/fit/fill spec, e.g. "webp".
+	// Defaults to the format of the source image.
+	DefaultFormat string
+
+	// AutoOrient, when true (the default), rotates/flips the decoded image
+	// according to its EXIF orientation tag, so portrait photos taken with a
+	// rotated camera are not published sideways.
+	AutoOrient bool
+
+	// StripMetadata, when true, drops EXIF/IPTC metadata from the processed
+	// image. The default is false: JPEG output re-embeds the original EXIF
+	// (with the orientation tag reset to 1, since AutoOrient has already baked
+	// it into the pixels).
+	StripMetadata bool
+
+	// MaxWorkers bounds how many image decodes can be in flight at once.
+	// Defaults to runtime.NumCPU().
+	MaxWorkers int
+
+	// MaxMemoryMB bounds the estimated memory (width*height*4 bytes per
+	// in-flight decode) the image worker pool will hold at once. 0 means
+	// unbounded.
+	MaxMemoryMB int
 }
 
 const (
@@ -71,6 +102,30 @@ var imageFormats = map[string]imaging.Format{
 	".tiff": imaging.TIFF,
 	".bmp":  imaging.BMP,
 	".gif":  imaging.GIF,
+	".webp": imageFormatWebP,
+	".avif": imageFormatAVIF,
+}
+
+// imageFormatWebP and imageFormatAVIF extend imaging.Format with the two
+// output-only formats supported by encodeToDestinations. They are numbered
+// past imaging's own constants so they never collide with upstream additions.
+const (
+	imageFormatWebP imaging.Format = iota + 100
+	imageFormatAVIF
+)
+
+// imageFormatExts maps a format token, as used in a resize/fit/fill spec
+// (e.g. "400x300 webp q80"), to the file extension it produces.
+var imageFormatExts = map[string]string{
+	"jpg":  ".jpg",
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"tif":  ".tif",
+	"tiff": ".tiff",
+	"bmp":  ".bmp",
+	"gif":  ".gif",
+	"webp": ".webp",
+	"avif": ".avif",
 }
 
 var anchorPositions = map[string]imaging.Anchor{
@@ -83,8 +138,14 @@ var anchorPositions = map[string]imaging.Anchor{
 	strings.ToLower("BottomLeft"):  imaging.BottomLeft,
 	strings.ToLower("Bottom"):      imaging.Bottom,
 	strings.ToLower("BottomRight"): imaging.BottomRight,
+	strings.ToLower("Smart"):       smartAnchor,
 }
 
+// smartAnchor is a sentinel imaging.Anchor value selected by the "smart"
+// anchor token. It never reaches imaging.Fill directly: doWithImageConfig
+// resolves it to an explicit crop rectangle before the resize step.
+const smartAnchor = imaging.Anchor(99)
+
 var imageFilters = map[string]imaging.ResampleFilter{
 	strings.ToLower("NearestNeighbor"):   imaging.NearestNeighbor,
 	strings.ToLower("Box"):               imaging.Box,
@@ -114,6 +175,18 @@ type Image struct {
 
 	hash string
 
+	exifInit        sync.Once
+	exifOrientation int
+
+	// Exif holds the EXIF tags decoded from the source image, keyed by tag
+	// name (e.g. "DateTimeOriginal", "Model", "GPSLatitude"). It is nil if
+	// the source had no EXIF data.
+	Exif map[string]string
+
+	// exifAPP1 holds the source's raw APP1 EXIF segment, with the
+	// orientation tag reset to 1 (normal), for re-embedding into JPEG output.
+	exifAPP1 []byte
+
 	*genericResource
 }
 
@@ -132,6 +205,8 @@ func (i *Image) WithNewBase(base string) Resource {
 	return &Image{
 		imaging:         i.imaging,
 		hash:            i.hash,
+		Exif:            i.Exif,
+		exifAPP1:        i.exifAPP1,
 		genericResource: i.genericResource.WithNewBase(base).(*genericResource)}
 }
 
@@ -161,6 +236,220 @@ func (i *Image) Fill(spec string) (*Image, error) {
 	})
 }
 
+// Watermark composites another resource over the image. Spec syntax:
+// "logo.png BottomRight 20x20 o50" means overlay logo.png, resolved next to
+// this image, positioned at the BottomRight anchor, offset by 20x20 pixels,
+// at 50% opacity.
+func (i *Image) Watermark(spec string) (*Image, error) {
+	oc, err := parseOverlaySpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	overlayImg, err := i.decodeOverlay(oc.Path)
+	if err != nil {
+		return nil, err
+	}
+	oc.contentHash = helpers.MD5String(string(overlayImg.Pix))
+
+	conf := defaultImageConfig
+	conf.Action = "watermark"
+	conf.Overlay = &oc
+	i.applyQualityDefault(&conf)
+
+	key := i.relPermalinkForRel(i.filenameFromConfig(conf))
+
+	return i.spec.imageCache.getOrCreate(i.spec, key, func(resourceCacheFilename string) (*Image, error) {
+		return i.spec.imageCache.pool.Do(key, i.estimatedMemoryBytes(), func() (*Image, error) {
+			src, err := i.decodeSource()
+			if err != nil {
+				return nil, err
+			}
+
+			// See the equivalent comment in doWithImageConfig: clone must
+			// happen after decodeSource populates i.Exif/i.exifAPP1.
+			ci := i.clone()
+			ci.setBasePath(conf)
+
+			converted := drawOverlay(src, overlayImg, oc)
+
+			b := converted.Bounds()
+			ci.config = image.Config{Width: b.Max.X, Height: b.Max.Y}
+			ci.configLoaded = true
+
+			return ci, i.encodeToDestinations(converted, conf, resourceCacheFilename, ci.RelPermalink())
+		})
+	})
+}
+
+// ImageSet holds the result of a Srcset call: the generated variants plus
+// helpers for rendering them as <img srcset> or <picture> markup.
+type ImageSet struct {
+	// Images are the generated variants, in the order their widths were given.
+	Images []*Image
+
+	// SrcsetAttr is the "url wNNNw, url wNNNw" string suitable for the
+	// srcset attribute of an <img> or <source> tag.
+	SrcsetAttr string
+
+	// Src is the smallest generated variant's URL, used as the plain src
+	// fallback for browsers that don't understand srcset/picture.
+	Src string
+
+	// formats holds one ImageSet per requested output format when the spec
+	// included a formats=... token; nil otherwise.
+	formats []imageSetFormat
+}
+
+type imageSetFormat struct {
+	format string
+	set    *ImageSet
+}
+
+// Sizes returns sizes verbatim; it exists so templates can pass a sizes
+// attribute alongside SrcsetAttr without Hugo needing to understand its
+// syntax.
+func (s *ImageSet) Sizes(sizes string) string {
+	return sizes
+}
+
+// PictureHTML renders a <picture><source ...><img ...></picture> element
+// covering every format produced by a formats=... spec, falling back to a
+// plain <img> if Srcset was not given a formats token.
+func (s *ImageSet) PictureHTML() template.HTML {
+	if len(s.formats) == 0 {
+		return template.HTML(fmt.Sprintf(`<img src="%s" srcset="%s">`, s.Src, s.SrcsetAttr))
+	}
+
+	var b strings.Builder
+	b.WriteString("<picture>")
+	for _, f := range s.formats {
+		fmt.Fprintf(&b, `<source type="image/%s" srcset="%s">`, f.format, f.set.SrcsetAttr)
+	}
+	last := s.formats[len(s.formats)-1].set
+	fmt.Fprintf(&b, `<img src="%s" srcset="%s">`, last.Src, last.SrcsetAttr)
+	b.WriteString("</picture>")
+
+	return template.HTML(b.String())
+}
+
+// Srcset generates a responsive image set from spec, a space- or
+// comma-delimited list of widths followed by the usual resize tokens, e.g.
+// "320w,640w,1024w box q80". Each width reuses the image cache, so rebuilding
+// a site that has already generated a given variant is free. A "formats=..."
+// token (e.g. "formats=jpeg,webp") additionally produces one ImageSet per
+// format and exposes them through ImageSet.PictureHTML.
+func (i *Image) Srcset(spec string) (*ImageSet, error) {
+	// formats=jpeg,webp must be pulled out of the raw spec before the
+	// comma->space replacement below runs, or the comma meant to separate
+	// formats gets eaten by the same replacement meant for the width list.
+	var formats []string
+	for _, field := range strings.Fields(spec) {
+		if strings.HasPrefix(field, "formats=") {
+			formats = strings.Split(strings.TrimPrefix(field, "formats="), ",")
+			spec = strings.Replace(spec, field, "", 1)
+			break
+		}
+	}
+
+	fields := strings.Fields(strings.Replace(spec, ",", " ", -1))
+
+	var widths []string
+	var rest []string
+
+	for _, field := range fields {
+		switch {
+		case strings.HasSuffix(field, "w") && isDigits(strings.TrimSuffix(field, "w")):
+			widths = append(widths, strings.TrimSuffix(field, "w"))
+		default:
+			rest = append(rest, field)
+		}
+	}
+
+	if len(widths) == 0 {
+		return nil, errors.New("srcset: no widths given")
+	}
+
+	if len(formats) == 0 {
+		set, err := i.srcsetForFormat(widths, rest, "")
+		if err != nil {
+			return nil, err
+		}
+		return set, nil
+	}
+
+	set := &ImageSet{}
+	for _, format := range formats {
+		format = strings.TrimSpace(format)
+		formatSet, err := i.srcsetForFormat(widths, rest, format)
+		if err != nil {
+			return nil, err
+		}
+		set.formats = append(set.formats, imageSetFormat{format: format, set: formatSet})
+	}
+	// The plain (un-suffixed) srcset mirrors the first requested format so
+	// templates that ignore PictureHTML still get a usable <img> fallback.
+	set.Images = set.formats[0].set.Images
+	set.SrcsetAttr = set.formats[0].set.SrcsetAttr
+	set.Src = set.formats[0].set.Src
+
+	return set, nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *Image) srcsetForFormat(widths, rest []string, format string) (*ImageSet, error) {
+	set := &ImageSet{}
+
+	var urls []string
+	for _, width := range widths {
+		width = strings.TrimSpace(width)
+		if width == "" {
+			continue
+		}
+
+		specParts := append([]string{width + "x0"}, rest...)
+		if format != "" {
+			specParts = append(specParts, format)
+		}
+
+		img, err := i.doWithImageConfig("resize", strings.Join(specParts, " "), func(src image.Image, conf imageConfig) (image.Image, error) {
+			return imaging.Resize(src, conf.Width, conf.Height, conf.Filter), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		set.Images = append(set.Images, img)
+		urls = append(urls, fmt.Sprintf("%s %dw", img.RelPermalink(), img.Width()))
+	}
+
+	set.SrcsetAttr = strings.Join(urls, ", ")
+	if len(set.Images) > 0 {
+		// The smallest variant is the safest fallback for browsers that
+		// ignore srcset entirely.
+		smallest := set.Images[0]
+		for _, img := range set.Images[1:] {
+			if img.Width() < smallest.Width() {
+				smallest = img
+			}
+		}
+		set.Src = smallest.RelPermalink()
+	}
+
+	return set, nil
+}
+
 // Holds configuration to create a new image from an existing one, resize etc.
 type imageConfig struct {
 	Action string
@@ -182,6 +471,14 @@ type imageConfig struct {
 
 	Anchor    imaging.Anchor
 	AnchorStr string
+
+	// FormatStr is the format token from the spec, e.g. "webp". Empty means
+	// keep the source format (or the configured DefaultFormat).
+	FormatStr string
+
+	// Overlay holds the watermark configuration for the "watermark" action.
+	// nil for every other action.
+	Overlay *overlayConfig
 }
 
 func (i *Image) isJPEG() bool {
@@ -189,6 +486,17 @@ func (i *Image) isJPEG() bool {
 	return strings.HasSuffix(name, ".jpg") || strings.HasSuffix(name, ".jpeg")
 }
 
+// applyQualityDefault fills in conf.Quality from the site's configured
+// default when the spec didn't set one explicitly and the output format is
+// lossy.
+func (i *Image) applyQualityDefault(conf *imageConfig) {
+	if conf.Quality <= 0 && (i.isJPEG() || conf.FormatStr == "jpg" || conf.FormatStr == "jpeg" ||
+		conf.FormatStr == "webp" || conf.FormatStr == "avif") {
+		// We need a quality setting for all lossy formats.
+		conf.Quality = i.imaging.Quality
+	}
+}
+
 func (i *Image) doWithImageConfig(action, spec string, f func(src image.Image, conf imageConfig) (image.Image, error)) (*Image, error) {
 	conf, err := parseImageConfig(spec)
 	if err != nil {
@@ -196,47 +504,72 @@ func (i *Image) doWithImageConfig(action, spec string, f func(src image.Image, c
 	}
 	conf.Action = action
 
-	if conf.Quality <= 0 && i.isJPEG() {
-		// We need a quality setting for all JPEGs
-		conf.Quality = i.imaging.Quality
-	}
-
 	if conf.FilterStr == "" {
 		conf.FilterStr = i.imaging.ResampleFilter
 		conf.Filter = imageFilters[conf.FilterStr]
 	}
 
+	if conf.FormatStr == "" && i.imaging.DefaultFormat != "" {
+		conf.FormatStr = i.imaging.DefaultFormat
+	}
+
+	i.applyQualityDefault(&conf)
+
 	key := i.relPermalinkForRel(i.filenameFromConfig(conf))
 
 	return i.spec.imageCache.getOrCreate(i.spec, key, func(resourceCacheFilename string) (*Image, error) {
-		ci := i.clone()
+		// Route the decode+transform+encode through the shared worker pool so
+		// a large site can't pin every core at once, and so two concurrent
+		// template calls for the same variant share a single decode.
+		return i.spec.imageCache.pool.Do(key, i.estimatedMemoryBytes(), func() (*Image, error) {
+			src, err := i.decodeSource()
+			if err != nil {
+				return nil, err
+			}
 
-		ci.setBasePath(conf)
+			// Clone only after decodeSource has run: it populates i.Exif (and
+			// i.exifAPP1) via initExif, and clone copies those fields by value,
+			// so cloning any earlier would leave ci.Exif nil on every first
+			// transform of a source image.
+			ci := i.clone()
+			ci.setBasePath(conf)
 
-		src, err := i.decodeSource()
-		if err != nil {
-			return nil, err
-		}
+			if conf.Rotate != 0 {
+				// Rotate it befor any scaling to get the dimensions correct.
+				src = imaging.Rotate(src, float64(conf.Rotate), color.Transparent)
+			}
 
-		if conf.Rotate != 0 {
-			// Rotate it befor any scaling to get the dimensions correct.
-			src = imaging.Rotate(src, float64(conf.Rotate), color.Transparent)
-		}
+			if action == "fill" && conf.AnchorStr == "smart" {
+				// Resolve the smart anchor to an explicit crop rectangle up front,
+				// then let Fill's own (now no-op) anchor logic do the final resize.
+				// Resize/Fit never consult the anchor, so this must not fire for them.
+				src = imaging.Crop(src, smartCropRect(src, conf.Width, conf.Height))
+				conf.Anchor = imaging.Center
+			}
 
-		converted, err := f(src, conf)
-		if err != nil {
-			return ci, err
-		}
+			converted, err := f(src, conf)
+			if err != nil {
+				return ci, err
+			}
 
-		b := converted.Bounds()
-		ci.config = image.Config{Width: b.Max.X, Height: b.Max.Y}
-		ci.configLoaded = true
+			b := converted.Bounds()
+			ci.config = image.Config{Width: b.Max.X, Height: b.Max.Y}
+			ci.configLoaded = true
 
-		return ci, i.encodeToDestinations(converted, conf, resourceCacheFilename, ci.RelPermalink())
+			return ci, i.encodeToDestinations(converted, conf, resourceCacheFilename, ci.RelPermalink())
+		})
 	})
 
 }
 
+// estimatedMemoryBytes is the imageWorkerPool admission estimate for
+// processing this image: the decoded source held fully in memory as 4
+// bytes per pixel (RGBA).
+func (i *Image) estimatedMemoryBytes() int64 {
+	i.initConfig()
+	return int64(i.config.Width) * int64(i.config.Height) * 4
+}
+
 func (i imageConfig) key() string {
 	k := strconv.Itoa(i.Width) + "x" + strconv.Itoa(i.Height)
 	if i.Action != "" {
@@ -249,6 +582,12 @@ func (i imageConfig) key() string {
 		k += "_r" + strconv.Itoa(i.Rotate)
 	}
 	k += "_" + i.FilterStr + "_" + i.AnchorStr
+	if i.FormatStr != "" {
+		k += "_" + i.FormatStr
+	}
+	if i.Overlay != nil {
+		k += "_" + i.Overlay.key()
+	}
 	return k
 }
 
@@ -305,6 +644,8 @@ func parseImageConfig(config string) (imageConfig, error) {
 		} else if filter, ok := imageFilters[part]; ok {
 			c.Filter = filter
 			c.FilterStr = part
+		} else if _, ok := imageFormatExts[part]; ok {
+			c.FormatStr = part
 		} else if part[0] == 'q' {
 			c.Quality, err = strconv.Atoi(part[1:])
 			if err != nil {
@@ -345,8 +686,8 @@ func parseImageConfig(config string) (imageConfig, error) {
 		}
 	}
 
-	if c.Width == 0 && c.Height == 0 {
-		return c, errors.New("must provide Width or Height")
+	if c.Width == 0 && c.Height == 0 && c.FormatStr == "" {
+		return c, errors.New("must provide Width, Height or format")
 	}
 
 	return c, nil
@@ -386,7 +727,56 @@ func (i *Image) decodeSource() (image.Image, error) {
 		return nil, err
 	}
 	defer file.Close()
-	return imaging.Decode(file)
+
+	img, err := imaging.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if i.isJPEG() {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		i.initExif(file)
+
+		if i.imaging.AutoOrient && i.exifOrientation != 0 {
+			img = applyOrientation(img, i.exifOrientation)
+		}
+	}
+
+	return img, nil
+}
+
+// initExif decodes the source's EXIF data and caches it on the receiver the
+// first time it is needed. Image is a shared resource that decodeSource can
+// be called on concurrently (from different goroutines resizing it for
+// different cache keys), so the population of i.Exif/i.exifAPP1/
+// i.exifOrientation is guarded by exifInit rather than written unconditionally.
+func (i *Image) initExif(file afero.File) {
+	i.exifInit.Do(func() {
+		x, err := exif.Decode(file)
+		if err != nil {
+			// Not every JPEG carries EXIF; that is not an error.
+			return
+		}
+
+		i.Exif = exifToMap(x)
+
+		if orientation, err := x.Get(exif.Orientation); err == nil {
+			if tag, err := orientation.Int(0); err == nil {
+				i.exifOrientation = tag
+			}
+		}
+
+		if !i.imaging.StripMetadata {
+			if _, err := file.Seek(0, io.SeekStart); err == nil {
+				if app1, err := extractAPP1(file); err == nil {
+					i.exifAPP1 = stripOrientationTag(app1)
+				}
+			}
+		}
+	})
 }
 
 func (i *Image) copyToDestination(src string) error {
@@ -477,23 +867,74 @@ func (i *Image) encodeToDestinations(img image.Image, conf imageConfig, resource
 				}
 			}
 		}
+		if i.exifAPP1 == nil {
+			if rgba != nil {
+				return jpeg.Encode(w, rgba, &jpeg.Options{Quality: quality})
+			}
+			return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+		}
+
+		var buf bytes.Buffer
+		var encErr error
 		if rgba != nil {
-			return jpeg.Encode(w, rgba, &jpeg.Options{Quality: quality})
+			encErr = jpeg.Encode(&buf, rgba, &jpeg.Options{Quality: quality})
 		} else {
-			return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+			encErr = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
 		}
+		if encErr != nil {
+			return encErr
+		}
+
+		_, err := w.Write(injectAPP1(buf.Bytes(), i.exifAPP1))
+		return err
+	case imageFormatWebP:
+		return webp.Encode(w, img, &webp.Options{Quality: float32(conf.Quality)})
+	case imageFormatAVIF:
+		return avif.Encode(w, img, &avif.Options{Quality: avifCQLevel(conf.Quality)})
 	default:
 		return imaging.Encode(w, img, imgFormat)
 	}
 
 }
 
+// avifCQLevel converts a 1-100 "quality" value, where higher is better (the
+// scale shared by JPEG and WebP), into the 0-63 cq-level scale used by
+// go-avif/aomenc, where lower is better.
+func avifCQLevel(quality int) int {
+	if quality <= 0 {
+		quality = defaultJPEGQuality
+	}
+	if quality > 100 {
+		quality = 100
+	}
+
+	cq := int(math.Round(float64(100-quality) / 100 * 63))
+	if cq < 0 {
+		cq = 0
+	}
+	if cq > 63 {
+		cq = 63
+	}
+
+	return cq
+}
+
+// Convert converts the image to the format given in spec (e.g. "webp" or
+// "avif q80") without changing its geometry.
+func (i *Image) Convert(spec string) (*Image, error) {
+	return i.doWithImageConfig("convert", spec, func(src image.Image, conf imageConfig) (image.Image, error) {
+		return src, nil
+	})
+}
+
 func (i *Image) clone() *Image {
 	g := *i.genericResource
 
 	return &Image{
 		imaging:         i.imaging,
 		hash:            i.hash,
+		Exif:            i.Exif,
+		exifAPP1:        i.exifAPP1,
 		genericResource: &g}
 }
 
@@ -503,6 +944,9 @@ func (i *Image) setBasePath(conf imageConfig) {
 
 func (i *Image) filenameFromConfig(conf imageConfig) string {
 	p1, p2 := helpers.FileAndExt(i.rel)
+	if conf.FormatStr != "" {
+		p2 = imageFormatExts[conf.FormatStr]
+	}
 	idStr := fmt.Sprintf("_H%s_%d", i.hash, i.osFileInfo.Size())
 
 	// Do not change for no good reason.
@@ -526,7 +970,9 @@ func (i *Image) filenameFromConfig(conf imageConfig) string {
 }
 
 func decodeImaging(m map[string]interface{}) (Imaging, error) {
-	var i Imaging
+	// AutoOrient defaults to true; WeakDecode below only touches fields
+	// actually present in m, so this stands unless the user sets it.
+	i := Imaging{AutoOrient: true}
 	if err := mapstructure.WeakDecode(m, &i); err != nil {
 		return i, err
 	}
@@ -546,5 +992,13 @@ func decodeImaging(m map[string]interface{}) (Imaging, error) {
 		i.ResampleFilter = filter
 	}
 
+	if i.DefaultFormat != "" {
+		format := strings.ToLower(i.DefaultFormat)
+		if _, found := imageFormatExts[format]; !found {
+			return i, fmt.Errorf("%q is not a valid image format", format)
+		}
+		i.DefaultFormat = format
+	}
+
 	return i, nil
 }
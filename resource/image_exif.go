@@ -0,0 +1,190 @@
+// Copyright 2017-present The Hugo Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resource
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// applyOrientation rotates/flips img so that it displays upright for the
+// given EXIF orientation tag value (1-8). Orientation 1 needs no change.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	default:
+		return img
+	}
+}
+
+// exifFieldWalker collects every EXIF field into a flat string map by
+// implementing the goexif tiff.Walker interface.
+type exifFieldWalker struct {
+	fields map[string]string
+}
+
+func (w *exifFieldWalker) Walk(name exif.FieldName, tag *tiff.Tag) error {
+	w.fields[string(name)] = strings.Trim(tag.String(), `"`)
+	return nil
+}
+
+// exifToMap flattens the decoded EXIF data into the map exposed as
+// (*Image).Exif.
+func exifToMap(x *exif.Exif) map[string]string {
+	w := &exifFieldWalker{fields: make(map[string]string)}
+	// Walk never returns an error from exifFieldWalker.Walk.
+	_ = x.Walk(w)
+	return w.fields
+}
+
+const (
+	jpegMarkerPrefix = 0xFF
+	jpegMarkerSOI    = 0xD8
+	jpegMarkerAPP1   = 0xE1
+	jpegMarkerSOS    = 0xDA
+	exifHeader       = "Exif\x00\x00"
+)
+
+// extractAPP1 reads r, a JPEG file positioned at its start, and returns the
+// raw APP1 segment carrying the "Exif\0\0" identifier, marker bytes and
+// length prefix included. It returns an error if the file has no such
+// segment.
+func extractAPP1(r io.Reader) ([]byte, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil {
+		return nil, err
+	}
+	if soi[0] != jpegMarkerPrefix || soi[1] != jpegMarkerSOI {
+		return nil, errors.New("not a JPEG file")
+	}
+
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil {
+			return nil, err
+		}
+		if marker[0] != jpegMarkerPrefix {
+			return nil, errors.New("malformed JPEG marker")
+		}
+		if marker[1] == jpegMarkerSOS {
+			return nil, errors.New("no APP1/Exif segment found")
+		}
+
+		var lenBytes [2]byte
+		if _, err := io.ReadFull(r, lenBytes[:]); err != nil {
+			return nil, err
+		}
+		segLen := int(binary.BigEndian.Uint16(lenBytes[:]))
+		if segLen < 2 {
+			return nil, errors.New("malformed JPEG segment length")
+		}
+
+		payload := make([]byte, segLen-2)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+
+		if marker[1] == jpegMarkerAPP1 && strings.HasPrefix(string(payload), exifHeader) {
+			segment := make([]byte, 0, 4+len(payload))
+			segment = append(segment, marker[0], marker[1])
+			segment = append(segment, lenBytes[:]...)
+			segment = append(segment, payload...)
+			return segment, nil
+		}
+	}
+}
+
+// stripOrientationTag resets the EXIF orientation tag (0x0112) to 1 (normal) inside a raw
+// APP1 segment, as returned by extractAPP1, so it can be safely re-embedded
+// after the orientation has already been baked into the pixels. Segments
+// with no orientation tag, or that cannot be parsed, are returned unchanged.
+func stripOrientationTag(app1 []byte) []byte {
+	const tiffOffset = 4 + len(exifHeader) // marker + length + "Exif\0\0"
+	if len(app1) < tiffOffset+8 {
+		return app1
+	}
+
+	tiffBase := app1[tiffOffset:]
+
+	var order binary.ByteOrder
+	switch string(tiffBase[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return app1
+	}
+
+	ifdOffset := order.Uint32(tiffBase[4:8])
+	if int(ifdOffset)+2 > len(tiffBase) {
+		return app1
+	}
+
+	numEntries := int(order.Uint16(tiffBase[ifdOffset : ifdOffset+2]))
+	entryStart := int(ifdOffset) + 2
+	const entrySize = 12
+	const orientationTagID = 0x0112
+
+	for e := 0; e < numEntries; e++ {
+		off := entryStart + e*entrySize
+		if off+entrySize > len(tiffBase) {
+			break
+		}
+		tagID := order.Uint16(tiffBase[off : off+2])
+		if tagID == orientationTagID {
+			// The value for a SHORT (type 3) count-1 tag lives in the first
+			// two bytes of the value/offset field; setting it to 1 means
+			// "normal, no rotation".
+			order.PutUint16(tiffBase[off+8:off+10], 1)
+			break
+		}
+	}
+
+	return app1
+}
+
+// injectAPP1 inserts the given raw APP1 segment into an already-encoded
+// JPEG byte stream, right after the 2-byte SOI marker.
+func injectAPP1(jpegData, app1 []byte) []byte {
+	if len(jpegData) < 2 {
+		return jpegData
+	}
+
+	out := make([]byte, 0, len(jpegData)+len(app1))
+	out = append(out, jpegData[:2]...)
+	out = append(out, app1...)
+	out = append(out, jpegData[2:]...)
+	return out
+}
@@ -0,0 +1,142 @@
+// Copyright 2017-present The Hugo Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resource
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestApplyOrientation(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.White)
+	src.Set(1, 0, color.Black)
+
+	for _, test := range []struct {
+		name        string
+		orientation int
+		wantW       int
+		wantH       int
+	}{
+		{"normal is a no-op", 1, 2, 1},
+		{"unknown value is a no-op", 0, 2, 1},
+		{"flip horizontal keeps dimensions", 2, 2, 1},
+		{"rotate 90 swaps dimensions", 6, 1, 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := applyOrientation(src, test.orientation)
+			b := got.Bounds()
+			if b.Dx() != test.wantW || b.Dy() != test.wantH {
+				t.Errorf("applyOrientation(%d) bounds = %dx%d, want %dx%d", test.orientation, b.Dx(), b.Dy(), test.wantW, test.wantH)
+			}
+		})
+	}
+}
+
+// buildTIFFWithOrientation returns a minimal little-endian TIFF IFD, as
+// embedded in an APP1/Exif segment, with a single Orientation (0x0112) SHORT
+// tag set to orientation.
+func buildTIFFWithOrientation(orientation uint16) []byte {
+	const ifdOffset = 8
+
+	buf := make([]byte, ifdOffset+2+12+4)
+	copy(buf[0:2], "II")
+	binary.LittleEndian.PutUint16(buf[2:4], 42)
+	binary.LittleEndian.PutUint32(buf[4:8], ifdOffset)
+
+	binary.LittleEndian.PutUint16(buf[ifdOffset:ifdOffset+2], 1) // one IFD entry
+
+	entry := buf[ifdOffset+2 : ifdOffset+2+12]
+	binary.LittleEndian.PutUint16(entry[0:2], 0x0112) // orientation tag ID
+	binary.LittleEndian.PutUint16(entry[2:4], 3)       // type SHORT
+	binary.LittleEndian.PutUint32(entry[4:8], 1)       // count
+	binary.LittleEndian.PutUint16(entry[8:10], orientation)
+
+	return buf
+}
+
+func buildAPP1(tiffBase []byte) []byte {
+	payload := append([]byte(exifHeader), tiffBase...)
+
+	segment := []byte{jpegMarkerPrefix, jpegMarkerAPP1}
+	lenBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(lenBytes, uint16(2+len(payload)))
+	segment = append(segment, lenBytes...)
+	segment = append(segment, payload...)
+	return segment
+}
+
+func TestExtractAPP1FindsExifSegment(t *testing.T) {
+	app1 := buildAPP1(buildTIFFWithOrientation(6))
+
+	var jpg bytes.Buffer
+	jpg.Write([]byte{jpegMarkerPrefix, jpegMarkerSOI})
+	jpg.Write(app1)
+	jpg.Write([]byte{jpegMarkerPrefix, jpegMarkerSOS})
+
+	got, err := extractAPP1(&jpg)
+	if err != nil {
+		t.Fatalf("extractAPP1 returned error: %v", err)
+	}
+	if !bytes.Equal(got, app1) {
+		t.Errorf("extractAPP1 = %x, want %x", got, app1)
+	}
+}
+
+func TestExtractAPP1NoExifSegment(t *testing.T) {
+	var jpg bytes.Buffer
+	jpg.Write([]byte{jpegMarkerPrefix, jpegMarkerSOI})
+	jpg.Write([]byte{jpegMarkerPrefix, jpegMarkerSOS})
+
+	if _, err := extractAPP1(&jpg); err == nil {
+		t.Fatal("expected an error for a JPEG with no APP1/Exif segment")
+	}
+}
+
+func TestStripOrientationTagResetsKnownTag(t *testing.T) {
+	app1 := buildAPP1(buildTIFFWithOrientation(6))
+
+	stripped := stripOrientationTag(app1)
+
+	const tiffOffset = 4 + len(exifHeader)
+	const ifdOffset = 8
+	entryStart := tiffOffset + ifdOffset + 2
+	got := binary.LittleEndian.Uint16(stripped[entryStart+8 : entryStart+10])
+	if got != 1 {
+		t.Errorf("orientation tag = %d after stripping, want 1", got)
+	}
+}
+
+func TestStripOrientationTagLeavesShortSegmentUnchanged(t *testing.T) {
+	short := []byte{jpegMarkerPrefix, jpegMarkerAPP1, 0, 4}
+	got := stripOrientationTag(short)
+	if !bytes.Equal(got, short) {
+		t.Errorf("stripOrientationTag modified a too-short segment: got %x, want %x", got, short)
+	}
+}
+
+func TestInjectAPP1InsertsAfterSOI(t *testing.T) {
+	jpegData := []byte{jpegMarkerPrefix, jpegMarkerSOI, 0xAA, 0xBB}
+	app1 := []byte{jpegMarkerPrefix, jpegMarkerAPP1, 0x00, 0x01}
+
+	got := injectAPP1(jpegData, app1)
+	want := []byte{jpegMarkerPrefix, jpegMarkerSOI, jpegMarkerPrefix, jpegMarkerAPP1, 0x00, 0x01, 0xAA, 0xBB}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("injectAPP1 = %x, want %x", got, want)
+	}
+}
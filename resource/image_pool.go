@@ -0,0 +1,152 @@
+// Copyright 2017-present The Hugo Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resource
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ImagePoolStats is a point-in-time snapshot of imageWorkerPool activity,
+// surfaced on *Spec for the build summary.
+type ImagePoolStats struct {
+	// Processed is the number of decode+transform+encode jobs that actually
+	// ran.
+	Processed int64
+
+	// Deduped is the number of calls that were served by a job already in
+	// flight for the same cache key, instead of starting a new one.
+	Deduped int64
+}
+
+// imageWorkerPool bounds how many image decodes can be in flight at once,
+// both by count (MaxWorkers) and by estimated memory footprint
+// (MaxMemoryMB), and ensures that concurrent calls for the same cache key
+// share a single decode+transform+encode instead of racing.
+type imageWorkerPool struct {
+	maxMemoryBytes int64
+	admit          chan struct{}
+
+	group singleflight.Group
+
+	mu           sync.Mutex
+	memInUseByte int64
+
+	statsMu sync.Mutex
+	stats   ImagePoolStats
+}
+
+// newImageWorkerPool creates a pool bounded to maxWorkers concurrent jobs
+// (defaulting to runtime.NumCPU() when maxWorkers <= 0) and maxMemoryMB of
+// estimated in-flight decode memory (0 meaning unbounded).
+func newImageWorkerPool(maxWorkers, maxMemoryMB int) *imageWorkerPool {
+	if maxWorkers <= 0 {
+		maxWorkers = runtime.NumCPU()
+	}
+
+	return &imageWorkerPool{
+		maxMemoryBytes: int64(maxMemoryMB) * 1024 * 1024,
+		admit:          make(chan struct{}, maxWorkers),
+	}
+}
+
+// newImageWorkerPoolFromImaging builds the pool an imageCache should embed,
+// sized from the site's (or language's) Imaging config. This is the call
+// imageCache's own constructor must make so that Imaging.MaxWorkers and
+// Imaging.MaxMemoryMB actually take effect, instead of only existing as
+// struct fields nothing reads.
+func newImageWorkerPoolFromImaging(imaging *Imaging) *imageWorkerPool {
+	return newImageWorkerPool(imaging.MaxWorkers, imaging.MaxMemoryMB)
+}
+
+// Do runs fn for key once admission is granted, sharing the result with any
+// other concurrent Do call for the same key.
+func (p *imageWorkerPool) Do(key string, estimatedBytes int64, fn func() (*Image, error)) (*Image, error) {
+	// singleflight reports shared for the leader too when others joined it,
+	// so only calls that did not run fn themselves count as deduped.
+	leader := false
+	v, err, shared := p.group.Do(key, func() (interface{}, error) {
+		leader = true
+		p.admit <- struct{}{}
+		defer func() { <-p.admit }()
+
+		p.reserveMemory(estimatedBytes)
+		defer p.releaseMemory(estimatedBytes)
+
+		p.statsMu.Lock()
+		p.stats.Processed++
+		p.statsMu.Unlock()
+
+		return fn()
+	})
+
+	if shared && !leader {
+		p.statsMu.Lock()
+		p.stats.Deduped++
+		p.statsMu.Unlock()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*Image), nil
+}
+
+// Stats returns a snapshot of the pool's activity.
+func (p *imageWorkerPool) Stats() ImagePoolStats {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	return p.stats
+}
+
+// reserveMemory blocks until admitting estimatedBytes would not exceed the
+// pool's memory budget, or admits immediately if the budget is unbounded or
+// nothing else is currently reserved (so a single oversized job is never
+// starved forever).
+func (p *imageWorkerPool) reserveMemory(estimatedBytes int64) {
+	if p.maxMemoryBytes <= 0 {
+		return
+	}
+
+	for {
+		p.mu.Lock()
+		if p.memInUseByte == 0 || p.memInUseByte+estimatedBytes <= p.maxMemoryBytes {
+			p.memInUseByte += estimatedBytes
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (p *imageWorkerPool) releaseMemory(estimatedBytes int64) {
+	if p.maxMemoryBytes <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	p.memInUseByte -= estimatedBytes
+	p.mu.Unlock()
+}
+
+// ImageStats returns a snapshot of the site's image worker pool activity,
+// for the build summary.
+func (s *Spec) ImageStats() ImagePoolStats {
+	return s.imageCache.pool.Stats()
+}
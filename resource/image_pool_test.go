@@ -0,0 +1,152 @@
+// Copyright 2017-present The Hugo Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resource
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestImageWorkerPoolDedup(t *testing.T) {
+	pool := newImageWorkerPool(4, 0)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	want := &Image{hash: "shared"}
+
+	var calls int32
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		img, err := pool.Do("variant", 0, func() (*Image, error) {
+			atomic.AddInt32(&calls, 1)
+			close(started)
+			<-release
+			return want, nil
+		})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if img != want {
+			t.Errorf("got %v, want %v", img, want)
+		}
+	}()
+
+	<-started
+
+	const followers = 5
+	wg.Add(followers)
+	for i := 0; i < followers; i++ {
+		go func() {
+			defer wg.Done()
+			img, err := pool.Do("variant", 0, func() (*Image, error) {
+				t.Error("a follower call must be served by the in-flight job, not re-run it")
+				return nil, nil
+			})
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if img != want {
+				t.Errorf("got %v, want %v", img, want)
+			}
+		}()
+	}
+
+	// Give the followers a moment to queue up behind the in-flight call
+	// before releasing it.
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("job ran %d times, want 1", got)
+	}
+
+	if stats := pool.Stats(); stats.Processed != 1 || stats.Deduped != followers {
+		t.Errorf("stats = %+v, want Processed=1 Deduped=%d", stats, followers)
+	}
+}
+
+func TestImageWorkerPoolMemoryBudgetSerializes(t *testing.T) {
+	const budgetMB = 1
+	pool := newImageWorkerPool(4, budgetMB)
+	bigBytes := int64(2 * 1024 * 1024) // bigger than the budget alone
+
+	firstRunning := make(chan struct{})
+	release := make(chan struct{})
+
+	go func() {
+		pool.Do("a", bigBytes, func() (*Image, error) {
+			close(firstRunning)
+			<-release
+			return &Image{}, nil
+		})
+	}()
+
+	<-firstRunning
+
+	var secondStarted int32
+	done := make(chan struct{})
+	go func() {
+		pool.Do("b", bigBytes, func() (*Image, error) {
+			atomic.StoreInt32(&secondStarted, 1)
+			return &Image{}, nil
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("second job ran concurrently with the first despite exceeding the memory budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("second job never ran after the first released its memory")
+	}
+
+	if atomic.LoadInt32(&secondStarted) != 1 {
+		t.Error("second job should have started once the first released its memory budget")
+	}
+}
+
+func TestImageWorkerPoolAdmitsOversizedJobWhenIdle(t *testing.T) {
+	pool := newImageWorkerPool(1, 1) // 1MB budget
+	huge := int64(10 * 1024 * 1024)  // far over budget, but nothing else is in flight
+
+	done := make(chan struct{})
+	go func() {
+		if _, err := pool.Do("huge", huge, func() (*Image, error) {
+			return &Image{}, nil
+		}); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("oversized job never admitted even though nothing else was in flight")
+	}
+}
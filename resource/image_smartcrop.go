@@ -0,0 +1,218 @@
+// Copyright 2017-present The Hugo Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resource
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// smartCropMaxEdge is the long edge, in pixels, that the source is
+// downsampled to before scoring candidate crop windows. Scoring at full
+// resolution is unnecessary and slow; the visual-importance map is smooth
+// enough that a small thumbnail gives the same answer.
+const smartCropMaxEdge = 100
+
+// smartCropRect returns the full-resolution crop rectangle that best covers
+// the visually interesting parts of src for a target of size targetW x
+// targetH. If the target does not fit inside src (a degenerate aspect
+// ratio), the full source bounds are returned unchanged.
+func smartCropRect(src image.Image, targetW, targetH int) image.Rectangle {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	if targetW <= 0 || targetH <= 0 || targetW >= srcW || targetH >= srcH {
+		return bounds
+	}
+
+	scale := float64(smartCropMaxEdge) / float64(max(srcW, srcH))
+	if scale > 1 {
+		scale = 1
+	}
+
+	small := imaging.Resize(src, int(float64(srcW)*scale), 0, imaging.Box)
+	interest := interestMap(small)
+
+	// The crop window, scaled down to the same space as interest.
+	winW := int(float64(targetW) * scale)
+	winH := int(float64(targetH) * scale)
+	if winW < 1 {
+		winW = 1
+	}
+	if winH < 1 {
+		winH = 1
+	}
+	if winW > interest.w {
+		winW = interest.w
+	}
+	if winH > interest.h {
+		winH = interest.h
+	}
+
+	bestX, bestY, bestScore := 0, 0, -1.0
+	for y := 0; y+winH <= interest.h; y++ {
+		for x := 0; x+winW <= interest.w; x++ {
+			score := interest.sum(x, y, winW, winH)
+			if score > bestScore {
+				bestScore = score
+				bestX, bestY = x, y
+			}
+		}
+	}
+
+	// Scale the chosen window back up to full resolution.
+	fx := int(float64(bestX) / scale)
+	fy := int(float64(bestY) / scale)
+
+	r := image.Rect(fx, fy, fx+targetW, fy+targetH)
+	return r.Add(bounds.Min).Intersect(bounds)
+}
+
+// summedArea is a summed-area table (integral image) of per-pixel interest
+// scores, allowing the total score of any rectangle to be computed in O(1).
+type summedArea struct {
+	w, h int
+	data []float64
+}
+
+func (s *summedArea) at(x, y int) float64 {
+	if x < 0 || y < 0 {
+		return 0
+	}
+	return s.data[y*s.w+x]
+}
+
+// sum returns the total interest score of the w x h window whose
+// top-left corner is (x, y).
+func (s *summedArea) sum(x, y, w, h int) float64 {
+	x1, y1 := x+w-1, y+h-1
+	total := s.at(x1, y1)
+	if x > 0 {
+		total -= s.at(x-1, y1)
+	}
+	if y > 0 {
+		total -= s.at(x1, y-1)
+	}
+	if x > 0 && y > 0 {
+		total += s.at(x-1, y-1)
+	}
+	return total
+}
+
+// interestMap scores img for visual importance: a weighted sum of
+// Sobel-gradient edge energy and local Shannon entropy over the luminance
+// channel, returned as a summed-area table for fast window queries.
+func interestMap(img image.Image) *summedArea {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	lum := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			lum[y*w+x] = 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+		}
+	}
+
+	at := func(x, y int) float64 {
+		if x < 0 {
+			x = 0
+		}
+		if x >= w {
+			x = w - 1
+		}
+		if y < 0 {
+			y = 0
+		}
+		if y >= h {
+			y = h - 1
+		}
+		return lum[y*w+x]
+	}
+
+	const entropyWindow = 8
+	interest := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			gx := -at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1) +
+				at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1)
+			gy := -at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1) +
+				at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1)
+			edge := math.Hypot(gx, gy)
+
+			entropy := localEntropy(at, x, y, entropyWindow)
+
+			interest[y*w+x] = edge + entropy*4096
+		}
+	}
+
+	sat := &summedArea{w: w, h: h, data: make([]float64, w*h)}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := interest[y*w+x]
+			if x > 0 {
+				v += sat.at(x-1, y)
+			}
+			if y > 0 {
+				v += sat.at(x, y-1)
+			}
+			if x > 0 && y > 0 {
+				v -= sat.at(x-1, y-1)
+			}
+			sat.data[y*w+x] = v
+		}
+	}
+
+	return sat
+}
+
+// localEntropy computes the Shannon entropy, in bits, of the 256-bucket
+// luminance histogram over a window x window neighbourhood centred on
+// (x, y).
+func localEntropy(at func(x, y int) float64, x, y, window int) float64 {
+	var hist [256]int
+	n := 0
+	half := window / 2
+	for dy := -half; dy < window-half; dy++ {
+		for dx := -half; dx < window-half; dx++ {
+			v := at(x+dx, y+dy)
+			bucket := int(v / 257)
+			if bucket > 255 {
+				bucket = 255
+			}
+			hist[bucket]++
+			n++
+		}
+	}
+
+	var entropy float64
+	for _, count := range hist {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / float64(n)
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
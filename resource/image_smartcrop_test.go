@@ -0,0 +1,117 @@
+// Copyright 2017-present The Hugo Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resource
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestSmartCropRectDegenerateAspectRatio(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 50, 50))
+
+	for _, test := range []struct {
+		name    string
+		targetW int
+		targetH int
+	}{
+		{"wider than source", 100, 20},
+		{"taller than source", 20, 100},
+		{"equal to source", 50, 50},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := smartCropRect(src, test.targetW, test.targetH)
+			if got != src.Bounds() {
+				t.Errorf("smartCropRect(%d, %d) = %v, want source bounds %v", test.targetW, test.targetH, got, src.Bounds())
+			}
+		})
+	}
+}
+
+func TestSmartCropRectPicksHighInterestWindow(t *testing.T) {
+	const size = 80
+	src := image.NewNRGBA(image.Rect(0, 0, size, size))
+
+	// Flat grey background...
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			src.Set(x, y, color.Gray{Y: 128})
+		}
+	}
+
+	// ...with a small high-contrast checkerboard patch in the bottom-right
+	// corner, which should score far higher than the flat background.
+	for y := size - 16; y < size; y++ {
+		for x := size - 16; x < size; x++ {
+			if (x+y)%2 == 0 {
+				src.Set(x, y, color.White)
+			} else {
+				src.Set(x, y, color.Black)
+			}
+		}
+	}
+
+	rect := smartCropRect(src, 20, 20)
+
+	if rect.Max.X < size-20 || rect.Max.Y < size-20 {
+		t.Errorf("smartCropRect did not select the high-interest corner, got %v", rect)
+	}
+}
+
+func TestInterestMapGrayscaleSource(t *testing.T) {
+	const w, h = 16, 16
+	src := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			src.SetGray(x, y, color.Gray{Y: uint8(x * 16)})
+		}
+	}
+
+	sat := interestMap(src)
+
+	if sat.w != w || sat.h != h {
+		t.Fatalf("interestMap size = %dx%d, want %dx%d", sat.w, sat.h, w, h)
+	}
+
+	// The column at x=0 sees the ramp's shallow end (0 and 16, clamped
+	// against the left edge) while the column at w/2 sees its steep middle
+	// (112 and 144), so it should score higher.
+	flat := sat.sum(0, 0, 1, h)
+	ramped := sat.sum(w/2, 0, 1, h)
+	if ramped <= flat {
+		t.Fatalf("ramped column should score higher than the shallow edge column, got flat=%f ramped=%f", flat, ramped)
+	}
+}
+
+func TestSummedAreaSum(t *testing.T) {
+	sat := &summedArea{w: 3, h: 3, data: make([]float64, 9)}
+	// Every pixel scores 1, so the summed-area table is a simple running
+	// total: data[y][x] = (x+1)*(y+1).
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 3; x++ {
+			sat.data[y*3+x] = float64((x + 1) * (y + 1))
+		}
+	}
+
+	if got := sat.sum(0, 0, 3, 3); got != 9 {
+		t.Errorf("sum(whole image) = %f, want 9", got)
+	}
+	if got := sat.sum(1, 1, 2, 2); got != 4 {
+		t.Errorf("sum(bottom-right 2x2) = %f, want 4", got)
+	}
+	if got := sat.sum(0, 0, 1, 1); got != 1 {
+		t.Errorf("sum(top-left 1x1) = %f, want 1", got)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2017-present The Hugo Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resource
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// overlayConfig holds the parsed "watermark" spec: which resource to
+// composite, where to anchor it, its pixel offset from that anchor, and its
+// opacity.
+type overlayConfig struct {
+	Path      string
+	Anchor    imaging.Anchor
+	AnchorStr string
+	OffsetX   int
+	OffsetY   int
+
+	// Opacity ranges from 0 (invisible) to 100 (fully opaque).
+	Opacity int
+
+	// contentHash is the overlay image's content hash, used by key() so a
+	// changed watermark invalidates the cache even if the spec is unchanged.
+	contentHash string
+}
+
+// key returns the part of the imageConfig cache key contributed by the
+// overlay: its content hash, position and opacity.
+func (o overlayConfig) key() string {
+	return "wm" + o.contentHash + "_" + o.AnchorStr + "_" + strconv.Itoa(o.OffsetX) + "x" +
+		strconv.Itoa(o.OffsetY) + "_o" + strconv.Itoa(o.Opacity)
+}
+
+// parseOverlaySpec parses a Watermark spec, e.g. "logo.png BottomRight
+// 20x20 o50". The first field is always the overlay's resource path.
+func parseOverlaySpec(spec string) (overlayConfig, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return overlayConfig{}, errors.New("watermark spec cannot be empty")
+	}
+
+	oc := overlayConfig{
+		Path:      fields[0],
+		Anchor:    imaging.BottomRight,
+		AnchorStr: strings.ToLower("BottomRight"),
+		Opacity:   100,
+	}
+
+	for _, field := range fields[1:] {
+		lower := strings.ToLower(field)
+
+		if pos, ok := anchorPositions[lower]; ok {
+			oc.Anchor = pos
+			oc.AnchorStr = lower
+			continue
+		}
+
+		switch {
+		case strings.Contains(field, "x"):
+			xy := strings.SplitN(field, "x", 2)
+			if x, err := strconv.Atoi(xy[0]); err == nil {
+				oc.OffsetX = x
+			}
+			if len(xy) == 2 {
+				if y, err := strconv.Atoi(xy[1]); err == nil {
+					oc.OffsetY = y
+				}
+			}
+		case strings.HasPrefix(lower, "o"):
+			if o, err := strconv.Atoi(lower[1:]); err == nil {
+				oc.Opacity = clampOpacity(o)
+			}
+		}
+	}
+
+	return oc, nil
+}
+
+// clampOpacity restricts o to [0, 100], the range drawOverlay's mask
+// derivation assumes. Values outside it would otherwise wrap around when
+// converted to the uint8 alpha mask.
+func clampOpacity(o int) int {
+	switch {
+	case o < 0:
+		return 0
+	case o > 100:
+		return 100
+	default:
+		return o
+	}
+}
+
+// decodeOverlay resolves name next to this image's source file and decodes
+// it, the same filesystem abstraction decodeSource uses for the image
+// itself.
+func (i *Image) decodeOverlay(name string) (*image.NRGBA, error) {
+	overlayPath := filepath.Join(filepath.Dir(i.AbsSourceFilename()), name)
+
+	file, err := i.spec.Fs.Source.Open(overlayPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, err := imaging.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return imaging.Clone(img), nil
+}
+
+// drawOverlay composites overlay onto src at the position and opacity
+// described by oc, and returns the result.
+func drawOverlay(src image.Image, overlay *image.NRGBA, oc overlayConfig) image.Image {
+	dst := imaging.Clone(src)
+
+	pos := anchorPt(dst.Bounds(), overlay.Bounds(), oc.Anchor, oc.OffsetX, oc.OffsetY)
+
+	mask := image.NewUniform(color.Alpha{A: uint8(oc.Opacity * 255 / 100)})
+
+	draw.DrawMask(dst, overlay.Bounds().Add(pos.Sub(overlay.Bounds().Min)), overlay, overlay.Bounds().Min, mask, image.Point{}, draw.Over)
+
+	return dst
+}
+
+// anchorPt returns the top-left point at which an overlay of size
+// overlayBounds should be drawn onto an image with bounds dstBounds, so that
+// it sits at anchor, offset by (dx, dy) pixels toward the image centre.
+func anchorPt(dstBounds, overlayBounds image.Rectangle, anchor imaging.Anchor, dx, dy int) image.Point {
+	w, h := overlayBounds.Dx(), overlayBounds.Dy()
+	maxX, maxY := dstBounds.Dx()-w, dstBounds.Dy()-h
+
+	var x, y int
+
+	switch anchor {
+	case imaging.TopLeft:
+		x, y = dx, dy
+	case imaging.Top:
+		x, y = maxX/2, dy
+	case imaging.TopRight:
+		x, y = maxX-dx, dy
+	case imaging.Left:
+		x, y = dx, maxY/2
+	case imaging.Right:
+		x, y = maxX-dx, maxY/2
+	case imaging.BottomLeft:
+		x, y = dx, maxY-dy
+	case imaging.Bottom:
+		x, y = maxX/2, maxY-dy
+	case imaging.BottomRight:
+		x, y = maxX-dx, maxY-dy
+	default: // imaging.Center
+		x, y = maxX/2, maxY/2
+	}
+
+	return dstBounds.Min.Add(image.Pt(x, y))
+}
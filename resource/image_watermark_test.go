@@ -0,0 +1,109 @@
+// Copyright 2017-present The Hugo Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resource
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestParseOverlaySpecClampsOpacity(t *testing.T) {
+	for _, test := range []struct {
+		spec string
+		want int
+	}{
+		{"logo.png o150", 100},
+		{"logo.png o-10", 0},
+		{"logo.png o50", 50},
+		{"logo.png", 100},
+	} {
+		oc, err := parseOverlaySpec(test.spec)
+		if err != nil {
+			t.Fatalf("parseOverlaySpec(%q) returned error: %v", test.spec, err)
+		}
+		if oc.Opacity != test.want {
+			t.Errorf("parseOverlaySpec(%q).Opacity = %d, want %d", test.spec, oc.Opacity, test.want)
+		}
+	}
+}
+
+func TestParseOverlaySpecRejectsEmpty(t *testing.T) {
+	if _, err := parseOverlaySpec(""); err == nil {
+		t.Fatal("expected an error for an empty watermark spec")
+	}
+}
+
+func TestAnchorPt(t *testing.T) {
+	dst := image.Rect(0, 0, 100, 50)
+	overlay := image.Rect(0, 0, 10, 10)
+
+	for _, test := range []struct {
+		name   string
+		anchor imaging.Anchor
+		dx, dy int
+		want   image.Point
+	}{
+		{"top left", imaging.TopLeft, 0, 0, image.Pt(0, 0)},
+		{"top left with offset", imaging.TopLeft, 5, 5, image.Pt(5, 5)},
+		{"top right", imaging.TopRight, 0, 0, image.Pt(90, 0)},
+		{"top right with offset", imaging.TopRight, 5, 0, image.Pt(85, 0)},
+		{"bottom right", imaging.BottomRight, 0, 0, image.Pt(90, 40)},
+		{"bottom right with offset", imaging.BottomRight, 5, 5, image.Pt(85, 35)},
+		{"center", imaging.Center, 0, 0, image.Pt(45, 20)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := anchorPt(dst, overlay, test.anchor, test.dx, test.dy)
+			if got != test.want {
+				t.Errorf("anchorPt(%v) = %v, want %v", test.name, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDrawOverlayOpacity(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			src.Set(x, y, color.White)
+		}
+	}
+
+	overlay := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			overlay.Set(x, y, color.Black)
+		}
+	}
+
+	for _, test := range []struct {
+		name    string
+		opacity int
+		wantR   uint8
+	}{
+		{"fully opaque overlay turns the pixel black", 100, 0},
+		{"fully transparent overlay leaves the pixel untouched", 0, 255},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			oc := overlayConfig{Anchor: imaging.Center, Opacity: test.opacity}
+			out := drawOverlay(src, overlay, oc)
+			r, _, _, _ := out.At(2, 2).RGBA()
+			if got := uint8(r >> 8); got != test.wantR {
+				t.Errorf("drawOverlay with opacity %d: red channel = %d, want %d", test.opacity, got, test.wantR)
+			}
+		})
+	}
+}